@@ -2,24 +2,303 @@ package sdk
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/go-furnace/proto/proto"
 	"github.com/hashicorp/go-plugin"
 	"google.golang.org/grpc"
 )
 
+// DefaultHookTimeout bounds how long the host waits on a plugin hook when
+// WithHookDeadline is called without an explicit timeout. Zero means no
+// deadline is applied.
+var DefaultHookTimeout time.Duration
+
+// WithHookDeadline returns a context bounded by timeout (falling back to
+// DefaultHookTimeout when timeout is zero or negative), along with its
+// cancel function. Hosts should wrap the context passed into ExecuteCtx
+// with this before invoking a hook, so a misbehaving plugin can't block a
+// create/delete indefinitely.
+func WithHookDeadline(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ProtocolVersion is the furnace plugin protocol version this SDK
+// implements. Bump it whenever a change here isn't wire-compatible with
+// older plugins or hosts; Handshake's ProtocolVersion mirrors it so
+// go-plugin itself refuses the connection at dispense time instead of
+// the mismatch surfacing opaquely mid-Execute.
+const ProtocolVersion = 2
+
+// Handshake is the go-plugin HandshakeConfig every furnace plugin and
+// host should use when configuring plugin.ServeConfig / plugin.ClientConfig.
+var Handshake = plugin.HandshakeConfig{
+	ProtocolVersion:  ProtocolVersion,
+	MagicCookieKey:   "FURNACE_PLUGIN",
+	MagicCookieValue: "furnace",
+}
+
+// Capabilities describes what a plugin supports. The host calls
+// GetCapabilities immediately after the handshake completes and uses
+// this to record incompatibilities with a clear error, rather than
+// failing opaquely mid-Execute when the proto evolves.
+type Capabilities struct {
+	ProtocolVersion   uint32
+	HookKinds         []string
+	Parameters        []string
+	SupportsStreaming bool
+	SupportsContext   bool
+}
+
+// capabilitiesFromProto converts a wire Capabilities message into a
+// Capabilities value.
+func capabilitiesFromProto(c *proto.Capabilities) Capabilities {
+	return Capabilities{
+		ProtocolVersion:   c.ProtocolVersion,
+		HookKinds:         c.HookKinds,
+		Parameters:        c.Parameters,
+		SupportsStreaming: c.SupportsStreaming,
+		SupportsContext:   c.SupportsContext,
+	}
+}
+
+// toProto renders a Capabilities value back into the wire message.
+func (c Capabilities) toProto() *proto.Capabilities {
+	return &proto.Capabilities{
+		ProtocolVersion:   c.ProtocolVersion,
+		HookKinds:         c.HookKinds,
+		Parameters:        c.Parameters,
+		SupportsStreaming: c.SupportsStreaming,
+		SupportsContext:   c.SupportsContext,
+	}
+}
+
+// CapabilitiesProvider is implemented by plugins that want to describe
+// what they support before any hook runs - which hook kinds they declare,
+// which stack parameters they consume, and whether they take advantage of
+// streaming events / context cancellation. Plugins that don't implement
+// it are reported with just ProtocolVersion set.
+type CapabilitiesProvider interface {
+	Capabilities() Capabilities
+}
+
+// CheckProtocolVersion returns an error describing the mismatch if caps
+// was reported by a plugin built against a different ProtocolVersion than
+// this SDK implements. Hosts should call this right after GetCapabilities
+// and refuse to dispense the plugin on error.
+//
+// This can only catch a mismatch for plugins that implement
+// CapabilitiesProvider: capabilitiesOf reports this SDK's own
+// ProtocolVersion for any plugin that doesn't, so CheckProtocolVersion
+// always passes for them. For those plugins, mismatch detection happens
+// earlier and is solely go-plugin's job - it compares Handshake's
+// ProtocolVersion against the plugin's at dispense time and refuses the
+// connection before GetCapabilities is ever reachable.
+func CheckProtocolVersion(caps Capabilities) error {
+	if caps.ProtocolVersion != ProtocolVersion {
+		return fmt.Errorf("sdk: plugin reports protocol version %d, host expects %d", caps.ProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// capabilitiesOf returns impl's declared Capabilities, defaulting to just
+// this SDK's ProtocolVersion if impl doesn't implement CapabilitiesProvider.
+// That default means CheckProtocolVersion can never see a mismatch for such
+// a plugin - see the note on CheckProtocolVersion.
+func capabilitiesOf(impl interface{}) Capabilities {
+	if provider, ok := impl.(CapabilitiesProvider); ok {
+		return provider.Capabilities()
+	}
+	return Capabilities{ProtocolVersion: ProtocolVersion}
+}
+
+/*
+ *
+ * Controller: a Shutdown RPC registered alongside every hook service, so
+ * the host can give a plugin a chance to clean up before killing it
+ * instead of SIGKILLing it outright.
+ *
+ */
+
+// shutdownMu guards shutdownHandlers, since OnShutdown can be called while
+// GRPCControllerServer.Shutdown is iterating it from a gRPC handler
+// goroutine.
+var (
+	shutdownMu       sync.Mutex
+	shutdownHandlers []func(ctx context.Context)
+)
+
+// OnShutdown registers fn to run when the host asks this plugin process
+// to shut down gracefully, via the Controller service's Shutdown RPC.
+// Plugin authors use this to flush logs, close DB connections, or
+// persist state before the process exits - this is especially useful for
+// PostCreate hooks that have opened external resources. Handlers run in
+// registration order and share the context passed to Shutdown.
+func OnShutdown(fn func(ctx context.Context)) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHandlers = append(shutdownHandlers, fn)
+}
+
+// DefaultShutdownGracePeriod bounds how long GRPCControllerClient.Shutdown
+// waits for a plugin's handlers to finish when called without an
+// explicit grace period.
+var DefaultShutdownGracePeriod = 5 * time.Second
+
+// controllerMu and controllerRegistered guard against registering the
+// Controller service twice on the same *grpc.Server. go-plugin serves
+// every entry of a plugin's PluginMap on one shared server, so a binary
+// exposing more than one hook kind would otherwise call
+// proto.RegisterControllerServer for each of them, and gRPC panics on
+// the second registration.
+var (
+	controllerMu         sync.Mutex
+	controllerRegistered = map[*grpc.Server]bool{}
+)
+
+// registerController registers the Controller service on s exactly once,
+// no matter how many of this plugin's hook GRPCServer methods are called
+// with the same underlying server.
+func registerController(s *grpc.Server) {
+	controllerMu.Lock()
+	defer controllerMu.Unlock()
+	if controllerRegistered[s] {
+		return
+	}
+	proto.RegisterControllerServer(s, GRPCControllerServer{})
+	controllerRegistered[s] = true
+}
+
+// GRPCControllerServer is the gRPC server for the Controller service. It's
+// registered alongside every hook service in each GRPCServer method, and
+// runs every handler registered via OnShutdown before replying.
+type GRPCControllerServer struct{}
+
+// Shutdown implements the Controller service's Shutdown RPC.
+func (GRPCControllerServer) Shutdown(ctx context.Context, _ *proto.Empty) (*proto.Empty, error) {
+	shutdownMu.Lock()
+	handlers := append([]func(ctx context.Context){}, shutdownHandlers...)
+	shutdownMu.Unlock()
+	for _, fn := range handlers {
+		fn(ctx)
+	}
+	return &proto.Empty{}, nil
+}
+
+// GRPCControllerClient talks to a plugin process's Controller service. A
+// furnace host gets one of these from every hook's GRPCClient, since
+// Controller is registered on the same connection as the hook itself.
+type GRPCControllerClient struct{ client proto.ControllerClient }
+
+// Shutdown asks the plugin to run its registered shutdown handlers,
+// waiting up to DefaultShutdownGracePeriod. Hosts should call this before
+// killing the plugin process.
+func (c *GRPCControllerClient) Shutdown(ctx context.Context) error {
+	return c.ShutdownWithGracePeriod(ctx, DefaultShutdownGracePeriod)
+}
+
+// ShutdownWithGracePeriod is Shutdown with an explicit grace period.
+func (c *GRPCControllerClient) ShutdownWithGracePeriod(ctx context.Context, grace time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	_, err := c.client.Shutdown(ctx, &proto.Empty{})
+	return err
+}
+
 /*
  *
  * Plugin interface declarations.
  *
  */
 
+// EventSink receives structured progress events emitted by a plugin while
+// it runs a hook. The host passes the concrete implementation into
+// ExecuteCtx; plugin authors call Emit as often as they like before
+// returning.
+type EventSink interface {
+	// Emit sends a single progress event upstream to the host. kv is an
+	// optional list of alternating key/value pairs, mirroring the
+	// convention used by structured loggers such as hclog.
+	Emit(level, msg string, kv ...interface{})
+}
+
+// StackInfo describes the stack a hook is running against. It replaces
+// the bare stackname string the original Execute signature took, giving
+// plugins access to everything the host knows about the stack - region,
+// provider, parameters, tags, and (for PostCreate/PostDelete) outputs -
+// without hard-coding credentials or re-querying the cloud provider.
+type StackInfo struct {
+	Name          string
+	Region        string
+	Provider      string
+	Parameters    map[string]string
+	Tags          map[string]string
+	Outputs       map[string]string
+	CorrelationID string
+}
+
+// stackInfoFromProto converts a wire Stack message into a StackInfo.
+func stackInfoFromProto(s *proto.Stack) StackInfo {
+	return StackInfo{
+		Name:          s.Name,
+		Region:        s.Region,
+		Provider:      s.Provider,
+		Parameters:    s.Parameters,
+		Tags:          s.Tags,
+		Outputs:       s.Outputs,
+		CorrelationID: s.CorrelationId,
+	}
+}
+
+// toProto renders a StackInfo back into the wire Stack message, carrying
+// forward the broker id the caller has already attached.
+func (s StackInfo) toProto(hostBrokerID uint32) *proto.Stack {
+	return &proto.Stack{
+		Name:          s.Name,
+		Region:        s.Region,
+		Provider:      s.Provider,
+		Parameters:    s.Parameters,
+		Tags:          s.Tags,
+		Outputs:       s.Outputs,
+		CorrelationId: s.CorrelationID,
+		HostBrokerId:  hostBrokerID,
+	}
+}
+
+// NoopEventSink is an EventSink that discards every event. It's used to
+// satisfy plugins still implementing the single-shot Execute signature,
+// which have nowhere to stream events to.
+type NoopEventSink struct{}
+
+// Emit implements EventSink by doing nothing.
+func (NoopEventSink) Emit(level, msg string, kv ...interface{}) {}
+
 // PreCreate is the interface for anything before the build happens. The
 // PreCreate plugin has the change to abort the build if returns false.
 type PreCreate interface {
 	Execute(stackname string) bool
 }
 
+// PreCreateCtx is implemented by PreCreate plugins that want to stream
+// structured progress events back to the host instead of returning a
+// single bool at the end. Plugins that only implement PreCreate keep
+// working unchanged; GRPCPreCreateServer downgrades to the old
+// single-shot behaviour for them.
+type PreCreateCtx interface {
+	ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink, host Host) (bool, error)
+}
+
 // PostCreate interface is the definition of the PostCreate api that can be
 // implemented and used via plugins. This interface gives access to the
 // stack name.
@@ -27,12 +306,27 @@ type PostCreate interface {
 	Execute(stackname string)
 }
 
+// PostCreateCtx is implemented by PostCreate plugins that want to stream
+// structured progress events back to the host. Plugins that only
+// implement PostCreate keep working unchanged.
+type PostCreateCtx interface {
+	ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink, host Host) error
+}
+
 // PreDelete is the interface for anything before the delete happens. The
 // PreDelete plugin has the change to abort the build if returns false.
 type PreDelete interface {
 	Execute(stackname string) bool
 }
 
+// PreDeleteCtx is implemented by PreDelete plugins that want to stream
+// structured progress events back to the host instead of returning a
+// single bool at the end. Plugins that only implement PreDelete keep
+// working unchanged.
+type PreDeleteCtx interface {
+	ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink, host Host) (bool, error)
+}
+
 // PostDelete interface is the definition of the PostDelete api that can be
 // implemented and used via plugins. This interface gives access to the
 // stack name.
@@ -40,6 +334,270 @@ type PostDelete interface {
 	Execute(stackname string)
 }
 
+// PostDeleteCtx is implemented by PostDelete plugins that want to stream
+// structured progress events back to the host. Plugins that only
+// implement PostDelete keep working unchanged.
+type PostDeleteCtx interface {
+	ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink, host Host) error
+}
+
+/*
+ *
+ * Shared streaming helpers.
+ *
+ */
+
+// eventStream is the subset of the generated *_ExecuteServer streaming
+// interfaces that grpcEventSink needs in order to relay events.
+type eventStream interface {
+	Send(*proto.Event) error
+}
+
+// grpcEventSink adapts a server-side gRPC stream to the EventSink
+// interface so hook implementations can Emit without knowing about the
+// wire format.
+type grpcEventSink struct {
+	stream eventStream
+}
+
+// Emit implements EventSink by sending a non-terminal event down the
+// stream. Send errors are swallowed here; the final terminal event (or
+// the error returned from Execute) is what the client actually observes.
+func (s *grpcEventSink) Emit(level, msg string, kv ...interface{}) {
+	s.stream.Send(&proto.Event{
+		Level:      level,
+		Message:    msg,
+		Attributes: attributesFromKV(kv),
+	})
+}
+
+// attributesFromKV flattens an alternating key/value list into the
+// map[string]string the Event proto carries. Non-string values are
+// rendered with a best-effort conversion; odd trailing keys are dropped.
+func attributesFromKV(kv []interface{}) map[string]string {
+	if len(kv) == 0 {
+		return nil
+	}
+	attrs := make(map[string]string, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		attrs[key] = toString(kv[i+1])
+	}
+	return attrs
+}
+
+// toString renders an Emit value as a string, special-casing the common
+// cases so plain strings and errors don't pick up quoting from %v.
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case error:
+		return val.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// errStreamClosedEarly is returned by drainEvents when the stream is
+// closed with a clean io.EOF before a terminal event ever arrived. That
+// shouldn't happen on a well-behaved plugin - it means the plugin closed
+// the stream early or crashed - so it must not be folded into a fabricated
+// proceed=false, which would silently mask the failure as a legitimate
+// "don't proceed" result.
+var errStreamClosedEarly = errors.New("sdk: stream closed before a terminal event was sent")
+
+// drainEvents reads events off a client-side stream, forwarding every
+// non-terminal one to sink, and returns the proceed/failed flag carried
+// by the terminal event. If the stream breaks because ctx was cancelled
+// or its deadline passed, the returned error is ctx.Err() rather than
+// whatever transport error gRPC happened to surface, so callers can tell
+// "the host gave up" apart from "the plugin reported failure".
+func drainEvents(ctx context.Context, stream interface{ Recv() (*proto.Event, error) }, sink EventSink) (bool, error) {
+	if sink == nil {
+		sink = NoopEventSink{}
+	}
+	for {
+		ev, err := stream.Recv()
+		if err == io.EOF {
+			return false, errStreamClosedEarly
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return false, ctxErr
+			}
+			return false, err
+		}
+		if ev.Terminal {
+			// ev.Failed is overloaded here to actually carry "proceed"
+			// (true = continue), matching what the server packs into it
+			// below - do not "fix" this into its literal name.
+			return ev.Failed, nil
+		}
+		sink.Emit(ev.Level, ev.Message, attributesToKV(ev.Attributes)...)
+	}
+}
+
+// attributesToKV expands the Event proto's attribute map back into an
+// alternating key/value list for EventSink.Emit.
+func attributesToKV(attrs map[string]string) []interface{} {
+	if len(attrs) == 0 {
+		return nil
+	}
+	kv := make([]interface{}, 0, len(attrs)*2)
+	for k, v := range attrs {
+		kv = append(kv, k, v)
+	}
+	return kv
+}
+
+/*
+ *
+ * Host services: a secondary gRPC connection, opened over the
+ * plugin.GRPCBroker already plumbed into every GRPCServer/GRPCClient,
+ * that lets a plugin call back into the furnace host during Execute.
+ *
+ */
+
+// Host is the handle ExecuteCtx passes to a hook so it can call back into
+// the furnace host while it runs. It's nil when the host hasn't
+// registered a HostServices implementation via RegisterHostServices.
+type Host interface {
+	// Log sends a structured log line to the host's own logger. This is
+	// separate from EventSink: EventSink is user-facing progress, Log is
+	// host-operator-facing diagnostics.
+	Log(level, msg string, kv ...interface{}) error
+	// GetSecret fetches a secret the host has access to (e.g. from its
+	// configured secrets manager) by name.
+	GetSecret(name string) (string, error)
+	// GetStackOutputs returns the outputs the host recorded for stackname.
+	GetStackOutputs(stackname string) (map[string]string, error)
+	// GetParameter returns the value of a single stack parameter by key.
+	GetParameter(key string) (string, error)
+}
+
+// hostServicesMu guards hostServices, since RegisterHostServices can race
+// with a hook's serveHost reading it from a concurrent Execute call.
+var (
+	hostServicesMu sync.RWMutex
+	// hostServices is the HostServices implementation this process serves
+	// to plugins over the broker during every subsequent Execute call.
+	// It's nil until a furnace host calls RegisterHostServices; plugin
+	// processes never set it, since only the host side serves
+	// HostServices.
+	hostServices proto.HostServicesServer
+)
+
+// RegisterHostServices installs impl as the HostServices implementation
+// this process serves to plugins during Execute. Furnace hosts call this
+// once during startup, before dispensing any PreCreate/PostCreate/
+// PreDelete/PostDelete plugin.
+func RegisterHostServices(impl proto.HostServicesServer) {
+	hostServicesMu.Lock()
+	defer hostServicesMu.Unlock()
+	hostServices = impl
+}
+
+// serveHostOn starts impl being served on lis and returns the server so
+// the caller can Stop() it. It's split out from serveHost so the
+// serve/stop lifecycle - in particular, that stop doesn't have to wait
+// for a peer to dial before it can tear the server down - can be unit
+// tested against a plain net.Listener, without a real broker.
+func serveHostOn(impl proto.HostServicesServer, lis net.Listener) *grpc.Server {
+	srv := grpc.NewServer()
+	proto.RegisterHostServicesServer(srv, impl)
+	go srv.Serve(lis)
+	return srv
+}
+
+// serveHost starts serving hostServices on broker under a fresh id if a
+// host has registered one, returning that id to hand to the plugin along
+// with a stop func the caller must invoke once the hook returns. broker.
+// Accept sets up the listener and returns immediately - it doesn't wait
+// for the plugin to dial it - so stop can call srv.Stop() directly
+// without blocking, even when the plugin never dials (e.g. an old-style
+// plugin that doesn't implement an XxxCtx interface and so never calls
+// dialHost at all). It returns id 0 and a no-op stop, meaning "no host
+// services available", if nothing is registered.
+func serveHost(broker *plugin.GRPCBroker) (id uint32, stop func()) {
+	hostServicesMu.RLock()
+	impl := hostServices
+	hostServicesMu.RUnlock()
+	if impl == nil || broker == nil {
+		return 0, func() {}
+	}
+	id = broker.NextId()
+	lis, err := broker.Accept(id)
+	if err != nil {
+		return 0, func() {}
+	}
+	srv := serveHostOn(impl, lis)
+	return id, srv.Stop
+}
+
+// dialHost dials the HostServices stream the host started under id,
+// returning a nil Host if id is 0 (the host didn't register any
+// HostServices). ctx is the hook's own context, so Host calls made
+// through the returned handle are cancelled the same way Execute itself
+// is. The returned close func releases the underlying broker connection
+// and must be called once the hook returns.
+func dialHost(ctx context.Context, broker *plugin.GRPCBroker, id uint32) (Host, func()) {
+	if id == 0 || broker == nil {
+		return nil, func() {}
+	}
+	conn, err := broker.Dial(id)
+	if err != nil {
+		return nil, func() {}
+	}
+	return &grpcHost{ctx: ctx, client: proto.NewHostServicesClient(conn)}, func() { conn.Close() }
+}
+
+// grpcHost is the gRPC-backed implementation of Host used by plugins.
+type grpcHost struct {
+	ctx    context.Context
+	client proto.HostServicesClient
+}
+
+// Log implements Host.
+func (h *grpcHost) Log(level, msg string, kv ...interface{}) error {
+	_, err := h.client.Log(h.ctx, &proto.LogRequest{
+		Level:      level,
+		Message:    msg,
+		Attributes: attributesFromKV(kv),
+	})
+	return err
+}
+
+// GetSecret implements Host.
+func (h *grpcHost) GetSecret(name string) (string, error) {
+	resp, err := h.client.GetSecret(h.ctx, &proto.GetSecretRequest{Name: name})
+	if err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// GetStackOutputs implements Host.
+func (h *grpcHost) GetStackOutputs(stackname string) (map[string]string, error) {
+	resp, err := h.client.GetStackOutputs(h.ctx, &proto.Stack{Name: stackname})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Outputs, nil
+}
+
+// GetParameter implements Host.
+func (h *grpcHost) GetParameter(key string) (string, error) {
+	resp, err := h.client.GetParameter(h.ctx, &proto.GetParameterRequest{Key: key})
+	if err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
 /*
  *
  * PRECREATE Plugin structs and functions.
@@ -58,42 +616,94 @@ type PreCreateGRPCPlugin struct {
 // GRPCServer is the grpc server implementation which calls the
 // protoc generated code to register it.
 func (p *PreCreateGRPCPlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
-	proto.RegisterPreCreateServer(s, &GRPCPreCreateServer{Impl: p.Impl})
+	proto.RegisterPreCreateServer(s, &GRPCPreCreateServer{Impl: p.Impl, broker: broker})
+	registerController(s)
 	return nil
 }
 
 // GRPCClient is the grpc client that will talk to the GRPC Server
 // and calls into the generated protoc code.
 func (p *PreCreateGRPCPlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
-	return &GRPCPreCreateClient{client: proto.NewPreCreateClient(c)}, nil
+	return &GRPCPreCreateClient{client: proto.NewPreCreateClient(c), broker: broker, Controller: &GRPCControllerClient{client: proto.NewControllerClient(c)}}, nil
 }
 
 // GRPCPreCreateClient is an implementation of PreCreate that talks over RPC.
-type GRPCPreCreateClient struct{ client proto.PreCreateClient }
+type GRPCPreCreateClient struct {
+	client proto.PreCreateClient
+	broker *plugin.GRPCBroker
+	// Controller lets the host ask this plugin to shut down gracefully
+	// before it's killed.
+	Controller *GRPCControllerClient
+}
 
 // Execute is the GRPC implementation of the Execute function for the
 // PreCreate plugin definition. This will talk over GRPC.
 func (m *GRPCPreCreateClient) Execute(key string) bool {
-	p, err := m.client.Execute(context.Background(), &proto.Stack{
-		Name: key,
-	})
+	proceed, _ := m.ExecuteCtx(context.Background(), StackInfo{Name: key}, NoopEventSink{})
+	return proceed
+}
+
+// ExecuteCtx streams the PreCreate hook, relaying every progress event to
+// sink as it arrives and returning the proceed/failed flag carried by the
+// terminal event. If a HostServices implementation has been registered
+// via RegisterHostServices, it's served to the plugin over the broker for
+// the duration of this call.
+func (m *GRPCPreCreateClient) ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink) (bool, error) {
+	hostBrokerID, stopHost := serveHost(m.broker)
+	defer stopHost()
+	stream, err := m.client.Execute(ctx, stack.toProto(hostBrokerID))
 	if err != nil {
-		return false
+		return false, err
 	}
-	return p.Failed
+	return drainEvents(ctx, stream, sink)
+}
+
+// GetCapabilities asks the plugin what it supports. Hosts should call
+// this immediately after dispensing the plugin and check the result with
+// CheckProtocolVersion before invoking Execute.
+func (m *GRPCPreCreateClient) GetCapabilities(ctx context.Context) (Capabilities, error) {
+	resp, err := m.client.GetCapabilities(ctx, &proto.Empty{})
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return capabilitiesFromProto(resp), nil
 }
 
 // GRPCPreCreateServer is the gRPC server that GRPCPreCreateClient talks to.
 type GRPCPreCreateServer struct {
 	// This is the real implementation
-	Impl PreCreate
+	Impl   PreCreate
+	broker *plugin.GRPCBroker
+}
+
+// Execute is the execute function of the GRPCServer which relays the
+// information to the underlying implementation of this interface. If
+// Impl also implements PreCreateCtx, progress events are streamed to the
+// host as they're emitted and Impl is handed a Host for calling back into
+// it; otherwise Execute falls back to a single terminal event carrying
+// the old bool result.
+func (m *GRPCPreCreateServer) Execute(req *proto.Stack, stream proto.PreCreate_ExecuteServer) error {
+	sink := &grpcEventSink{stream: stream}
+	if impl, ok := m.Impl.(PreCreateCtx); ok {
+		host, closeHost := dialHost(stream.Context(), m.broker, req.HostBrokerId)
+		defer closeHost()
+		proceed, err := impl.ExecuteCtx(stream.Context(), stackInfoFromProto(req), sink, host)
+		if err != nil {
+			return err
+		}
+		// Failed here actually carries "proceed" (true = continue), read
+		// back the same way by drainEvents - not a literal failure flag.
+		return stream.Send(&proto.Event{Terminal: true, Failed: proceed})
+	}
+	proceed := m.Impl.Execute(req.Name)
+	// Same overload as above: Failed carries "proceed", not a failure flag.
+	return stream.Send(&proto.Event{Terminal: true, Failed: proceed})
 }
 
-// Execute is the execute function of the GRPCServer which will rely the information to the
-// underlying implementation of this interface.
-func (m *GRPCPreCreateServer) Execute(ctx context.Context, req *proto.Stack) (*proto.Proceed, error) {
-	res := m.Impl.Execute(req.Name)
-	return &proto.Proceed{Failed: res}, nil
+// GetCapabilities reports what Impl supports, defaulting to just this
+// SDK's ProtocolVersion if Impl doesn't implement CapabilitiesProvider.
+func (m *GRPCPreCreateServer) GetCapabilities(ctx context.Context, _ *proto.Empty) (*proto.Capabilities, error) {
+	return capabilitiesOf(m.Impl).toProto(), nil
 }
 
 /*
@@ -112,40 +722,90 @@ type PostCreateGRPCPlugin struct {
 }
 
 // GRPCPostCreateClient is an implementation of PreCreate that talks over RPC.
-type GRPCPostCreateClient struct{ client proto.PostCreateClient }
+type GRPCPostCreateClient struct {
+	client proto.PostCreateClient
+	broker *plugin.GRPCBroker
+	// Controller lets the host ask this plugin to shut down gracefully
+	// before it's killed.
+	Controller *GRPCControllerClient
+}
 
 // Execute is the GRPC implementation of the Execute function for the
 // PostCreate plugin definition. This will talk over GRPC.
 func (m *GRPCPostCreateClient) Execute(stackname string) {
-	m.client.Execute(context.Background(), &proto.Stack{
-		Name: stackname,
-	})
+	m.ExecuteCtx(context.Background(), StackInfo{Name: stackname}, NoopEventSink{})
+}
+
+// ExecuteCtx streams the PostCreate hook, relaying every progress event
+// to sink as it arrives. If a HostServices implementation has been
+// registered via RegisterHostServices, it's served to the plugin over the
+// broker for the duration of this call.
+func (m *GRPCPostCreateClient) ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink) error {
+	hostBrokerID, stopHost := serveHost(m.broker)
+	defer stopHost()
+	stream, err := m.client.Execute(ctx, stack.toProto(hostBrokerID))
+	if err != nil {
+		return err
+	}
+	_, err = drainEvents(ctx, stream, sink)
+	return err
+}
+
+// GetCapabilities asks the plugin what it supports. Hosts should call
+// this immediately after dispensing the plugin and check the result with
+// CheckProtocolVersion before invoking Execute.
+func (m *GRPCPostCreateClient) GetCapabilities(ctx context.Context) (Capabilities, error) {
+	resp, err := m.client.GetCapabilities(ctx, &proto.Empty{})
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return capabilitiesFromProto(resp), nil
 }
 
 // GRPCPostCreateServer is the gRPC server that GRPCPostCreateClient talks to.
 type GRPCPostCreateServer struct {
 	// This is the real implementation
-	Impl PostCreate
+	Impl   PostCreate
+	broker *plugin.GRPCBroker
 }
 
 // GRPCServer is the grpc server implementation which calls the
 // protoc generated code to register it.
 func (p *PostCreateGRPCPlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
-	proto.RegisterPostCreateServer(s, &GRPCPostCreateServer{Impl: p.Impl})
+	proto.RegisterPostCreateServer(s, &GRPCPostCreateServer{Impl: p.Impl, broker: broker})
+	registerController(s)
 	return nil
 }
 
 // GRPCClient is the grpc client that will talk to the GRPC Server
 // and calls into the generated protoc code.
 func (p *PostCreateGRPCPlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
-	return &GRPCPostCreateClient{client: proto.NewPostCreateClient(c)}, nil
+	return &GRPCPostCreateClient{client: proto.NewPostCreateClient(c), broker: broker, Controller: &GRPCControllerClient{client: proto.NewControllerClient(c)}}, nil
 }
 
-// Execute is the execute functin of the GRPCServer which will rely the information to the
-// underlying implementation of this interface.
-func (m *GRPCPostCreateServer) Execute(ctx context.Context, req *proto.Stack) (*proto.Empty, error) {
+// Execute is the execute function of the GRPCServer which relays the
+// information to the underlying implementation of this interface. If
+// Impl also implements PostCreateCtx, progress events are streamed to the
+// host as they're emitted and Impl is handed a Host for calling back
+// into it.
+func (m *GRPCPostCreateServer) Execute(req *proto.Stack, stream proto.PostCreate_ExecuteServer) error {
+	sink := &grpcEventSink{stream: stream}
+	if impl, ok := m.Impl.(PostCreateCtx); ok {
+		host, closeHost := dialHost(stream.Context(), m.broker, req.HostBrokerId)
+		defer closeHost()
+		if err := impl.ExecuteCtx(stream.Context(), stackInfoFromProto(req), sink, host); err != nil {
+			return err
+		}
+		return stream.Send(&proto.Event{Terminal: true})
+	}
 	m.Impl.Execute(req.Name)
-	return &proto.Empty{}, nil
+	return stream.Send(&proto.Event{Terminal: true})
+}
+
+// GetCapabilities reports what Impl supports, defaulting to just this
+// SDK's ProtocolVersion if Impl doesn't implement CapabilitiesProvider.
+func (m *GRPCPostCreateServer) GetCapabilities(ctx context.Context, _ *proto.Empty) (*proto.Capabilities, error) {
+	return capabilitiesOf(m.Impl).toProto(), nil
 }
 
 /*
@@ -166,47 +826,99 @@ type PreDeleteGRPCPlugin struct {
 // GRPCServer is the grpc server implementation which calls the
 // protoc generated code to register it.
 func (p *PreDeleteGRPCPlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
-	proto.RegisterPreDeleteServer(s, &GRPCPreDeleteServer{Impl: p.Impl})
+	proto.RegisterPreDeleteServer(s, &GRPCPreDeleteServer{Impl: p.Impl, broker: broker})
+	registerController(s)
 	return nil
 }
 
 // GRPCClient is the grpc client that will talk to the GRPC Server
 // and calls into the generated protoc code.
 func (p *PreDeleteGRPCPlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
-	return &GRPCPreDeleteClient{client: proto.NewPreDeleteClient(c)}, nil
+	return &GRPCPreDeleteClient{client: proto.NewPreDeleteClient(c), broker: broker, Controller: &GRPCControllerClient{client: proto.NewControllerClient(c)}}, nil
 }
 
 // GRPCPreDeleteClient is an implementation of PreDelete that talks over RPC.
-type GRPCPreDeleteClient struct{ client proto.PreDeleteClient }
+type GRPCPreDeleteClient struct {
+	client proto.PreDeleteClient
+	broker *plugin.GRPCBroker
+	// Controller lets the host ask this plugin to shut down gracefully
+	// before it's killed.
+	Controller *GRPCControllerClient
+}
 
 // Execute is the GRPC implementation of the Execute function for the
 // PreDelete plugin definition. This will talk over GRPC.
 func (m *GRPCPreDeleteClient) Execute(key string) bool {
-	p, err := m.client.Execute(context.Background(), &proto.Stack{
-		Name: key,
-	})
+	proceed, _ := m.ExecuteCtx(context.Background(), StackInfo{Name: key}, NoopEventSink{})
+	return proceed
+}
+
+// ExecuteCtx streams the PreDelete hook, relaying every progress event to
+// sink as it arrives and returning the proceed/failed flag carried by the
+// terminal event. If a HostServices implementation has been registered
+// via RegisterHostServices, it's served to the plugin over the broker for
+// the duration of this call.
+func (m *GRPCPreDeleteClient) ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink) (bool, error) {
+	hostBrokerID, stopHost := serveHost(m.broker)
+	defer stopHost()
+	stream, err := m.client.Execute(ctx, stack.toProto(hostBrokerID))
+	if err != nil {
+		return false, err
+	}
+	return drainEvents(ctx, stream, sink)
+}
+
+// GetCapabilities asks the plugin what it supports. Hosts should call
+// this immediately after dispensing the plugin and check the result with
+// CheckProtocolVersion before invoking Execute.
+func (m *GRPCPreDeleteClient) GetCapabilities(ctx context.Context) (Capabilities, error) {
+	resp, err := m.client.GetCapabilities(ctx, &proto.Empty{})
 	if err != nil {
-		return false
+		return Capabilities{}, err
 	}
-	return p.Failed
+	return capabilitiesFromProto(resp), nil
 }
 
 // GRPCPreDeleteServer is the gRPC server that GRPCPreCreateClient talks to.
 type GRPCPreDeleteServer struct {
 	// This is the real implementation
-	Impl PreDelete
+	Impl   PreDelete
+	broker *plugin.GRPCBroker
 }
 
-// Execute is the execute function of the GRPCServer which will rely the information to the
-// underlying implementation of this interface.
-func (m *GRPCPreDeleteServer) Execute(ctx context.Context, req *proto.Stack) (*proto.Proceed, error) {
-	res := m.Impl.Execute(req.Name)
-	return &proto.Proceed{Failed: res}, nil
+// Execute is the execute function of the GRPCServer which relays the
+// information to the underlying implementation of this interface. If
+// Impl also implements PreDeleteCtx, progress events are streamed to the
+// host as they're emitted and Impl is handed a Host for calling back into
+// it; otherwise Execute falls back to a single terminal event carrying
+// the old bool result.
+func (m *GRPCPreDeleteServer) Execute(req *proto.Stack, stream proto.PreDelete_ExecuteServer) error {
+	sink := &grpcEventSink{stream: stream}
+	if impl, ok := m.Impl.(PreDeleteCtx); ok {
+		host, closeHost := dialHost(stream.Context(), m.broker, req.HostBrokerId)
+		defer closeHost()
+		proceed, err := impl.ExecuteCtx(stream.Context(), stackInfoFromProto(req), sink, host)
+		if err != nil {
+			return err
+		}
+		// Failed here actually carries "proceed" (true = continue), read
+		// back the same way by drainEvents - not a literal failure flag.
+		return stream.Send(&proto.Event{Terminal: true, Failed: proceed})
+	}
+	proceed := m.Impl.Execute(req.Name)
+	// Same overload as above: Failed carries "proceed", not a failure flag.
+	return stream.Send(&proto.Event{Terminal: true, Failed: proceed})
+}
+
+// GetCapabilities reports what Impl supports, defaulting to just this
+// SDK's ProtocolVersion if Impl doesn't implement CapabilitiesProvider.
+func (m *GRPCPreDeleteServer) GetCapabilities(ctx context.Context, _ *proto.Empty) (*proto.Capabilities, error) {
+	return capabilitiesOf(m.Impl).toProto(), nil
 }
 
 /*
  *
- * POSTCREATE Plugin structs and functions.
+ * POSTDELETE Plugin structs and functions.
  *
  */
 
@@ -220,38 +932,82 @@ type PostDeleteGRPCPlugin struct {
 }
 
 // GRPCPostDeleteClient is an implementation of PreCreate that talks over RPC.
-type GRPCPostDeleteClient struct{ client proto.PostDeleteClient }
+type GRPCPostDeleteClient struct {
+	client proto.PostDeleteClient
+	broker *plugin.GRPCBroker
+	// Controller lets the host ask this plugin to shut down gracefully
+	// before it's killed.
+	Controller *GRPCControllerClient
+}
 
 // Execute is the GRPC implementation of the Execute function for the
 // PostDelete plugin definition. This will talk over GRPC.
 func (m *GRPCPostDeleteClient) Execute(stackname string) {
-	m.client.Execute(context.Background(), &proto.Stack{
-		Name: stackname,
-	})
+	m.ExecuteCtx(context.Background(), StackInfo{Name: stackname}, NoopEventSink{})
+}
+
+// ExecuteCtx streams the PostDelete hook, relaying every progress event
+// to sink as it arrives. If a HostServices implementation has been
+// registered via RegisterHostServices, it's served to the plugin over the
+// broker for the duration of this call.
+func (m *GRPCPostDeleteClient) ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink) error {
+	hostBrokerID, stopHost := serveHost(m.broker)
+	defer stopHost()
+	stream, err := m.client.Execute(ctx, stack.toProto(hostBrokerID))
+	if err != nil {
+		return err
+	}
+	_, err = drainEvents(ctx, stream, sink)
+	return err
+}
+
+// GetCapabilities asks the plugin what it supports. Hosts should call
+// this immediately after dispensing the plugin and check the result with
+// CheckProtocolVersion before invoking Execute.
+func (m *GRPCPostDeleteClient) GetCapabilities(ctx context.Context) (Capabilities, error) {
+	resp, err := m.client.GetCapabilities(ctx, &proto.Empty{})
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return capabilitiesFromProto(resp), nil
 }
 
 // GRPCPostDeleteServer is the gRPC server that GRPCPostDeleteClient talks to.
 type GRPCPostDeleteServer struct {
 	// This is the real implementation
-	Impl PostDelete
+	Impl   PostDelete
+	broker *plugin.GRPCBroker
 }
 
 // GRPCServer is the grpc server implementation which calls the
 // protoc generated code to register it.
 func (p *PostDeleteGRPCPlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
-	proto.RegisterPostDeleteServer(s, &GRPCPostDeleteServer{Impl: p.Impl})
+	proto.RegisterPostDeleteServer(s, &GRPCPostDeleteServer{Impl: p.Impl, broker: broker})
+	registerController(s)
 	return nil
 }
 
 // GRPCClient is the grpc client that will talk to the GRPC Server
 // and calls into the generated protoc code.
 func (p *PostDeleteGRPCPlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
-	return &GRPCPostDeleteClient{client: proto.NewPostDeleteClient(c)}, nil
+	return &GRPCPostDeleteClient{client: proto.NewPostDeleteClient(c), broker: broker, Controller: &GRPCControllerClient{client: proto.NewControllerClient(c)}}, nil
 }
 
-// Execute is the execute functin of the GRPCServer which will rely the information to the
-// underlying implementation of this interface.
-func (m *GRPCPostDeleteServer) Execute(ctx context.Context, req *proto.Stack) (*proto.Empty, error) {
+// Execute is the execute function of the GRPCServer which relays the
+// information to the underlying implementation of this interface. If
+// Impl also implements PostDeleteCtx, progress events are streamed to the
+// host as they're emitted and Impl is handed a Host for calling back
+// into it.
+func (m *GRPCPostDeleteServer) Execute(req *proto.Stack, stream proto.PostDelete_ExecuteServer) error {
+	sink := &grpcEventSink{stream: stream}
+	if impl, ok := m.Impl.(PostDeleteCtx); ok {
+		host, closeHost := dialHost(stream.Context(), m.broker, req.HostBrokerId)
+		defer closeHost()
+		if err := impl.ExecuteCtx(stream.Context(), stackInfoFromProto(req), sink, host); err != nil {
+			return err
+		}
+		return stream.Send(&proto.Event{Terminal: true})
+	}
 	m.Impl.Execute(req.Name)
-	return &proto.Empty{}, nil
+	return stream.Send(&proto.Event{Terminal: true})
 }
@@ -0,0 +1,263 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-furnace/proto/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAttributesFromKV(t *testing.T) {
+	tests := []struct {
+		name string
+		kv   []interface{}
+		want map[string]string
+	}{
+		{
+			name: "empty",
+			kv:   nil,
+			want: nil,
+		},
+		{
+			name: "string values",
+			kv:   []interface{}{"region", "eu-west-1", "dryrun", "true"},
+			want: map[string]string{"region": "eu-west-1", "dryrun": "true"},
+		},
+		{
+			name: "non-string values are stringified",
+			kv:   []interface{}{"count", 3, "err", errors.New("boom")},
+			want: map[string]string{"count": "3", "err": "boom"},
+		},
+		{
+			name: "odd trailing key is dropped",
+			kv:   []interface{}{"region", "eu-west-1", "orphan"},
+			want: map[string]string{"region": "eu-west-1"},
+		},
+		{
+			name: "non-string key is skipped",
+			kv:   []interface{}{42, "ignored", "region", "eu-west-1"},
+			want: map[string]string{"region": "eu-west-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := attributesFromKV(tt.kv)
+			if len(got) != len(tt.want) {
+				t.Fatalf("attributesFromKV(%v) = %v, want %v", tt.kv, got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("attributesFromKV(%v)[%q] = %q, want %q", tt.kv, k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// fakeStream implements the minimal Recv interface drainEvents needs,
+// replaying a fixed sequence of events (and optionally a final error).
+type fakeStream struct {
+	events []*proto.Event
+	final  error
+	i      int
+}
+
+func (f *fakeStream) Recv() (*proto.Event, error) {
+	if f.i < len(f.events) {
+		ev := f.events[f.i]
+		f.i++
+		return ev, nil
+	}
+	if f.final != nil {
+		return nil, f.final
+	}
+	return nil, io.EOF
+}
+
+func TestDrainEvents(t *testing.T) {
+	t.Run("terminal event carries proceed", func(t *testing.T) {
+		stream := &fakeStream{events: []*proto.Event{
+			{Level: "info", Message: "building"},
+			{Terminal: true, Failed: true},
+		}}
+		proceed, err := drainEvents(context.Background(), stream, NoopEventSink{})
+		if err != nil {
+			t.Fatalf("drainEvents() error = %v, want nil", err)
+		}
+		if !proceed {
+			t.Errorf("drainEvents() proceed = false, want true")
+		}
+	})
+
+	t.Run("EOF before terminal event is an error", func(t *testing.T) {
+		stream := &fakeStream{events: []*proto.Event{
+			{Level: "info", Message: "building"},
+		}}
+		_, err := drainEvents(context.Background(), stream, NoopEventSink{})
+		if !errors.Is(err, errStreamClosedEarly) {
+			t.Fatalf("drainEvents() error = %v, want errStreamClosedEarly", err)
+		}
+	})
+
+	t.Run("ctx cancellation surfaces ctx.Err", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		stream := &fakeStream{final: errors.New("transport closed")}
+		_, err := drainEvents(ctx, stream, NoopEventSink{})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("drainEvents() error = %v, want context.Canceled", err)
+		}
+	})
+
+	t.Run("plain stream error is forwarded", func(t *testing.T) {
+		wantErr := errors.New("transport closed")
+		stream := &fakeStream{final: wantErr}
+		_, err := drainEvents(context.Background(), stream, NoopEventSink{})
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("drainEvents() error = %v, want %v", err, wantErr)
+		}
+	})
+}
+
+type fakeCapabilitiesProvider struct{ caps Capabilities }
+
+func (f fakeCapabilitiesProvider) Capabilities() Capabilities { return f.caps }
+
+func TestCapabilitiesOf(t *testing.T) {
+	t.Run("falls back to ProtocolVersion only", func(t *testing.T) {
+		got := capabilitiesOf(struct{}{})
+		want := Capabilities{ProtocolVersion: ProtocolVersion}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("capabilitiesOf(non-provider) = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("uses the provider's declared Capabilities", func(t *testing.T) {
+		declared := Capabilities{ProtocolVersion: ProtocolVersion, HookKinds: []string{"PreCreate"}}
+		got := capabilitiesOf(fakeCapabilitiesProvider{caps: declared})
+		if !reflect.DeepEqual(got, declared) {
+			t.Errorf("capabilitiesOf(provider) = %+v, want %+v", got, declared)
+		}
+	})
+}
+
+// fakeHostServices satisfies proto.HostServicesServer by embedding its
+// Unimplemented variant; serveHostOn only needs a value to register, not
+// one that actually answers calls.
+type fakeHostServices struct {
+	proto.UnimplementedHostServicesServer
+}
+
+func TestServeHost(t *testing.T) {
+	t.Run("nil broker returns id 0 and a no-op stop", func(t *testing.T) {
+		id, stop := serveHost(nil)
+		if id != 0 {
+			t.Errorf("serveHost(nil) id = %d, want 0", id)
+		}
+		stop()
+	})
+
+	t.Run("stop does not block waiting for a dial that never comes", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() error = %v", err)
+		}
+		srv := serveHostOn(fakeHostServices{}, lis)
+
+		done := make(chan struct{})
+		go func() {
+			srv.Stop()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("srv.Stop() blocked waiting for a dial that never came - this is the chunk0-3 hang")
+		}
+	})
+}
+
+func TestControllerServerShutdownRunsHandlersInOrder(t *testing.T) {
+	prevHandlers := shutdownHandlers
+	shutdownHandlers = nil
+	defer func() { shutdownHandlers = prevHandlers }()
+
+	var order []int
+	OnShutdown(func(ctx context.Context) { order = append(order, 1) })
+	OnShutdown(func(ctx context.Context) { order = append(order, 2) })
+
+	if _, err := (GRPCControllerServer{}).Shutdown(context.Background(), &proto.Empty{}); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Errorf("handlers ran in order %v, want [1 2]", order)
+	}
+}
+
+// fakeExecuteStream implements proto.PreCreate_ExecuteServer, recording
+// every event sent down it.
+type fakeExecuteStream struct {
+	ctx  context.Context
+	sent []*proto.Event
+}
+
+func (f *fakeExecuteStream) Send(ev *proto.Event) error {
+	f.sent = append(f.sent, ev)
+	return nil
+}
+func (f *fakeExecuteStream) Context() context.Context     { return f.ctx }
+func (f *fakeExecuteStream) SetHeader(metadata.MD) error  { return nil }
+func (f *fakeExecuteStream) SendHeader(metadata.MD) error { return nil }
+func (f *fakeExecuteStream) SetTrailer(metadata.MD)       {}
+func (f *fakeExecuteStream) SendMsg(interface{}) error    { return nil }
+func (f *fakeExecuteStream) RecvMsg(interface{}) error    { return nil }
+
+type fakeLegacyPreCreate struct{ proceed bool }
+
+func (f fakeLegacyPreCreate) Execute(stackname string) bool { return f.proceed }
+
+type fakeCtxPreCreate struct{ proceed bool }
+
+// Execute satisfies PreCreate, the type of GRPCPreCreateServer.Impl; the
+// server prefers ExecuteCtx whenever it's implemented.
+func (f fakeCtxPreCreate) Execute(stackname string) bool { return f.proceed }
+
+func (f fakeCtxPreCreate) ExecuteCtx(ctx context.Context, stack StackInfo, sink EventSink, host Host) (bool, error) {
+	sink.Emit("info", "working")
+	return f.proceed, nil
+}
+
+func TestGRPCPreCreateServerExecute(t *testing.T) {
+	t.Run("dispatches to ExecuteCtx when implemented", func(t *testing.T) {
+		srv := &GRPCPreCreateServer{Impl: fakeCtxPreCreate{proceed: true}}
+		stream := &fakeExecuteStream{ctx: context.Background()}
+		if err := srv.Execute(&proto.Stack{Name: "demo"}, stream); err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		if len(stream.sent) != 2 {
+			t.Fatalf("got %d events, want 2 (1 progress + 1 terminal)", len(stream.sent))
+		}
+		terminal := stream.sent[len(stream.sent)-1]
+		if !terminal.Terminal || !terminal.Failed {
+			t.Errorf("terminal event = %+v, want Terminal=true and Failed (proceed)=true", terminal)
+		}
+	})
+
+	t.Run("falls back to the legacy Execute signature", func(t *testing.T) {
+		srv := &GRPCPreCreateServer{Impl: fakeLegacyPreCreate{proceed: false}}
+		stream := &fakeExecuteStream{ctx: context.Background()}
+		if err := srv.Execute(&proto.Stack{Name: "demo"}, stream); err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		if len(stream.sent) != 1 || !stream.sent[0].Terminal || stream.sent[0].Failed {
+			t.Errorf("sent = %+v, want a single terminal event with Failed (proceed)=false", stream.sent)
+		}
+	})
+}